@@ -1,163 +1,167 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/hardwaylabs/learn-sse-bidirectional/go/jsonrpc"
+	"github.com/hardwaylabs/learn-sse-bidirectional/go/sseclient"
 )
 
-type Request struct {
-	ID      string `json:"id"`
-	Method  string `json:"method"`
-	Message string `json:"message"`
+// sseTransport implements jsonrpc.Transport over the server's
+// SSE + HTTP POST pair: Send POSTs to /message, Recv reads the next
+// JSON-RPC envelope off the (auto-reconnecting) event stream. The
+// bearer token handed out on (re)connect is cached for every Send
+// until a fresh one replaces it.
+type sseTransport struct {
+	clientID  string
+	serverURL string
+	stream    *sseclient.EventStream
+	client    *http.Client
+
+	mu    sync.Mutex
+	token string
 }
 
-type Response struct {
-	ID     string `json:"id"`
-	Result string `json:"result"`
+func (t *sseTransport) setToken(token string) {
+	t.mu.Lock()
+	t.token = token
+	t.mu.Unlock()
 }
 
-type ClientIDMessage struct {
-	Type string `json:"type"`
-	ID   string `json:"id"`
+func (t *sseTransport) getToken() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.token
 }
 
-func main() {
-	log.Println("🔗 Starting bidirectional SSE client...")
+func (t *sseTransport) Recv(ctx context.Context) (json.RawMessage, error) {
+	for {
+		event, err := t.stream.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	// Connect to SSE stream
-	req, err := http.NewRequest("GET", "http://localhost:8082/events?client_id=demo_client", nil)
-	if err != nil {
-		log.Fatalf("Failed to create request: %v", err)
-	}
+		if event.Type == "shutdown" {
+			log.Println("🛑 Server is shutting down")
+			return nil, io.EOF
+		}
+
+		// The server's bootstrap line isn't a JSON-RPC message; skip it.
+		var hello struct {
+			Type  string `json:"type"`
+			ID    string `json:"id"`
+			Token string `json:"token"`
+		}
+		if json.Unmarshal([]byte(event.Data), &hello) == nil && hello.Type == "client_id" {
+			log.Printf("🆔 Got client ID: %s", hello.ID)
+			t.setToken(hello.Token)
+			continue
+		}
 
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Cache-Control", "no-cache")
+		return json.RawMessage(event.Data), nil
+	}
+}
 
-	client := &http.Client{
-		Timeout: 0, // No timeout for SSE connection
+func (t *sseTransport) Send(ctx context.Context, msg json.RawMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.serverURL+"/message", bytes.NewReader(msg))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Client-ID", t.clientID)
+	req.Header.Set("Authorization", "Bearer "+t.getToken())
 
-	resp, err := client.Do(req)
+	resp, err := t.client.Do(req)
 	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+		return fmt.Errorf("failed to send message: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Server returned status: %d", resp.StatusCode)
+		return fmt.Errorf("server returned status: %d", resp.StatusCode)
 	}
+	return nil
+}
 
-	log.Printf("✅ Connected to SSE stream! Status: %d", resp.StatusCode)
-
-	var clientID string
-	
-	// Read SSE stream and handle requests
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, ":") {
-			continue
-		}
+type analyzeParams struct {
+	Message string `json:"message"`
+}
 
-		// Parse SSE data
-		if strings.HasPrefix(line, "data: ") {
-			data := strings.TrimPrefix(line, "data: ")
-			log.Printf("📨 Received SSE data: %s", data)
-
-			// Handle client ID message
-			var clientIDMsg ClientIDMessage
-			if json.Unmarshal([]byte(data), &clientIDMsg) == nil && clientIDMsg.Type == "client_id" {
-				clientID = clientIDMsg.ID
-				log.Printf("🆔 Got client ID: %s", clientID)
-				continue
-			}
-
-			// Handle request message
-			var request Request
-			if err := json.Unmarshal([]byte(data), &request); err != nil {
-				log.Printf("❌ Failed to parse request: %v", err)
-				continue
-			}
-
-			log.Printf("📥 Received request: ID=%s, Method=%s, Message=%s", 
-				request.ID, request.Method, request.Message)
-
-			// Process the request (simulate work)
-			result := processRequest(request)
-
-			// Send response back via HTTP POST
-			response := Response{
-				ID:     request.ID,
-				Result: result,
-			}
-
-			if err := sendResponse(clientID, response); err != nil {
-				log.Printf("❌ Failed to send response: %v", err)
-			} else {
-				log.Printf("📤 Sent response: %s", result)
-			}
-		}
+func handleAnalyze(ctx context.Context, params json.RawMessage) (any, error) {
+	var args analyzeParams
+	if err := jsonrpc.DecodeParams(params, &args); err != nil {
+		return nil, err
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("❌ SSE connection error: %v", err)
+	log.Printf("📥 Received request: Method=analyze, Message=%s", args.Message)
+	result, err := processMessage(ctx, args.Message)
+	if err != nil {
+		log.Printf("⏹️  Request canceled: %s", args.Message)
+		return nil, err
 	}
-
-	log.Println("🔚 SSE connection closed")
+	log.Printf("📤 Sending response: %s", result)
+	return result, nil
 }
 
-func processRequest(req Request) string {
-	// Simulate processing the request (like calling an LLM)
-	log.Printf("🔄 Processing request: %s", req.Message)
-	
-	// Simulate some work
-	time.Sleep(1 * time.Second)
-	
-	// Generate a mock response
-	switch req.Method {
-	case "analyze":
-		return fmt.Sprintf("Analysis result for '%s': This message contains %d characters and appears to be a %s request.", 
-			req.Message, len(req.Message), req.Method)
-	default:
-		return fmt.Sprintf("Processed '%s' using method '%s'", req.Message, req.Method)
+// processMessage simulates processing the request (like calling an
+// LLM). It watches ctx so a $/cancelRequest notification - relayed
+// here as ctx being canceled or hitting its deadline - stops the work
+// instead of running it to completion for no one.
+func processMessage(ctx context.Context, message string) (string, error) {
+	log.Printf("🔄 Processing request: %s", message)
+
+	select {
+	case <-time.After(1 * time.Second):
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
+
+	return fmt.Sprintf("Analysis result for '%s': This message contains %d characters and appears to be a analyze request.",
+		message, len(message)), nil
 }
 
-func sendResponse(clientID string, response Response) error {
-	// Convert response to JSON
-	jsonData, err := json.Marshal(response)
-	if err != nil {
-		return fmt.Errorf("failed to marshal response: %v", err)
-	}
+func main() {
+	serverURL := flag.String("server", "http://localhost:8082", "bidirectional server base URL")
+	clientID := flag.String("client-id", "demo_client", "client id to subscribe as")
+	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "skip TLS certificate verification (testing only)")
+	flag.Parse()
 
-	// Create HTTP POST request
-	req, err := http.NewRequest("POST", "http://localhost:8082/response", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+	log.Println("🔗 Starting bidirectional SSE client...")
+
+	var transport http.RoundTripper
+	if *insecureSkipVerify {
+		transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Client-ID", clientID)
+	// The SSE stream is intentionally long-lived (no timeout); the
+	// POST client needs one so a wedged server can't hang forever.
+	streamClient := &http.Client{Transport: transport}
+	postClient := &http.Client{Transport: transport, Timeout: 10 * time.Second}
 
-	// Send the response
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
+	stream := sseclient.Open(
+		fmt.Sprintf("%s/events?client_id=%s", *serverURL, *clientID),
+		sseclient.WithHTTPClient(streamClient),
+	)
+	defer stream.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status: %d", resp.StatusCode)
-	}
+	peerTransport := &sseTransport{clientID: *clientID, serverURL: *serverURL, stream: stream, client: postClient}
+	peer := jsonrpc.NewPeer(peerTransport)
+	peer.RegisterMethod("analyze", handleAnalyze)
 
-	return nil
-}
\ No newline at end of file
+	log.Println("✅ Serving requests (connects on first read, will auto-reconnect and resume on disconnect)")
+
+	if err := peer.Serve(context.Background()); err != nil {
+		log.Printf("❌ SSE connection error: %v", err)
+	}
+	log.Println("🔚 Connection closed")
+}
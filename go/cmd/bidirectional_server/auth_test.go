@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hardwaylabs/learn-sse-bidirectional/go/ratelimit"
+)
+
+// subscribeAndGetToken opens /events just long enough to read the
+// bootstrap client_id/token line, then closes the stream.
+func subscribeAndGetToken(t *testing.T, client *http.Client, baseURL, clientID string) string {
+	t.Helper()
+
+	resp, err := client.Get(baseURL + "/events?client_id=" + clientID)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() {
+		t.Fatalf("subscribe: no bootstrap line: %v", scanner.Err())
+	}
+
+	var hello struct {
+		Type  string `json:"type"`
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	line := strings.TrimPrefix(scanner.Text(), "data: ")
+	if err := json.Unmarshal([]byte(line), &hello); err != nil {
+		t.Fatalf("subscribe: bad bootstrap line %q: %v", line, err)
+	}
+	return hello.Token
+}
+
+func TestMessageRejectsMismatchedToken(t *testing.T) {
+	server := NewServer()
+	ts := httptest.NewServer(NewMux(server))
+	defer ts.Close()
+
+	const clientID = "auth-test"
+	token := subscribeAndGetToken(t, ts.Client(), ts.URL, clientID)
+
+	post := func(id, bearer string) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/message", strings.NewReader(`{"jsonrpc":"2.0","method":"ping"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Client-ID", id)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(clientID, "not-the-real-token"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: got status %d, want 401", code)
+	}
+	if code := post("someone-else", token); code != http.StatusUnauthorized {
+		t.Fatalf("token for a different client_id: got status %d, want 401", code)
+	}
+	if code := post(clientID, token); code != http.StatusOK {
+		t.Fatalf("correct client_id/token: got status %d, want 200", code)
+	}
+}
+
+func TestMessageIsRateLimited(t *testing.T) {
+	server := NewServer()
+	server.InboundLimiter = ratelimit.NewLimiter(0, 1) // one token, never refills
+	ts := httptest.NewServer(NewMux(server))
+	defer ts.Close()
+
+	const clientID = "rate-limit-test"
+	token := subscribeAndGetToken(t, ts.Client(), ts.URL, clientID)
+
+	post := func() int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/message", strings.NewReader(`{"jsonrpc":"2.0","method":"ping"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Client-ID", clientID)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("first POST: got status %d, want 200", code)
+	}
+	if code := post(); code != http.StatusTooManyRequests {
+		t.Fatalf("second POST: got status %d, want 429", code)
+	}
+}
+
+func TestEventsOverTLS(t *testing.T) {
+	server := NewServer()
+	ts := httptest.NewTLSServer(NewMux(server))
+	defer ts.Close()
+
+	token := subscribeAndGetToken(t, ts.Client(), ts.URL, "tls-test")
+	if token == "" {
+		t.Fatal("expected a non-empty token over TLS")
+	}
+}
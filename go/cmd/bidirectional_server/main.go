@@ -1,218 +1,529 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/hardwaylabs/learn-sse-bidirectional/go/auth"
+	"github.com/hardwaylabs/learn-sse-bidirectional/go/jsonrpc"
+	"github.com/hardwaylabs/learn-sse-bidirectional/go/ratelimit"
+)
+
+// replayBufferSize caps how many recently-sent messages each client
+// keeps around for Last-Event-ID replay on reconnect.
+const replayBufferSize = 64
+
+// defaultKeepAlive is how often /events writes an SSE comment line
+// to keep the connection alive through proxies that otherwise kill
+// it long before r.Context() notices.
+const defaultKeepAlive = 15 * time.Second
+
+// Default per-client rate limits, generous enough for interactive
+// use but enough to blunt a runaway or hostile client.
+const (
+	defaultRPS   = 5.0
+	defaultBurst = 10
 )
 
-// Simple request/response system over SSE + HTTP POST (like MCP)
-type Request struct {
-	ID      string `json:"id"`
-	Method  string `json:"method"`
-	Message string `json:"message"`
+// seqMessage pairs a raw JSON-RPC envelope with the monotonically
+// increasing SSE event id it was sent under, so a reconnecting
+// client can ask to resume after a given id. shutdown marks the
+// sentinel value used to end a client's stream during Shutdown.
+type seqMessage struct {
+	seq      uint64
+	raw      json.RawMessage
+	shutdown bool
+}
+
+// clientConn holds everything tied to one logical client: the
+// outbound SSE stream (with its replay buffer), the inbound channel
+// fed by POSTs to /message, and the JSON-RPC peer multiplexed over
+// both. It survives across SSE reconnects - only the live HTTP
+// connection streaming the outbox comes and goes.
+type clientConn struct {
+	outbox chan seqMessage
+	inbox  chan json.RawMessage
+
+	mu      sync.Mutex
+	buf     []seqMessage
+	nextSeq uint64
+
+	peer *jsonrpc.Peer
+}
+
+func newClientConn() *clientConn {
+	c := &clientConn{
+		outbox: make(chan seqMessage, 10),
+		inbox:  make(chan json.RawMessage, 10),
+	}
+	c.peer = jsonrpc.NewPeer(&sseTransport{conn: c})
+	return c
+}
+
+// push assigns the next seq to raw, remembers it for replay, and
+// queues it for delivery over the SSE stream.
+func (c *clientConn) push(raw json.RawMessage) uint64 {
+	c.mu.Lock()
+	c.nextSeq++
+	seq := c.nextSeq
+	c.buf = append(c.buf, seqMessage{seq: seq, raw: raw})
+	if len(c.buf) > replayBufferSize {
+		c.buf = c.buf[len(c.buf)-replayBufferSize:]
+	}
+	c.mu.Unlock()
+
+	c.outbox <- seqMessage{seq: seq, raw: raw}
+	return seq
 }
 
-type Response struct {
-	ID     string `json:"id"`
-	Result string `json:"result"`
+// since returns the buffered messages with seq greater than
+// lastSeq, oldest first, for replay after a reconnect.
+func (c *clientConn) since(lastSeq uint64) []seqMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var out []seqMessage
+	for _, sm := range c.buf {
+		if sm.seq > lastSeq {
+			out = append(out, sm)
+		}
+	}
+	return out
+}
+
+// sendShutdown queues the sentinel that tells an active /events
+// handler to emit a final "event: shutdown" frame and return.
+func (c *clientConn) sendShutdown() {
+	select {
+	case c.outbox <- seqMessage{shutdown: true}:
+	default:
+		// Outbox is full: the sentinel is dropped, and this client's
+		// stream gets no shutdown frame.
+	}
+}
+
+// sseTransport implements jsonrpc.Transport over a clientConn: Send
+// enqueues onto the SSE outbox (and the replay buffer), Recv reads
+// whatever the client last POSTed to /message.
+type sseTransport struct {
+	conn *clientConn
 }
 
+func (t *sseTransport) Send(ctx context.Context, msg json.RawMessage) error {
+	t.conn.push(msg)
+	return nil
+}
+
+func (t *sseTransport) Recv(ctx context.Context) (json.RawMessage, error) {
+	select {
+	case raw, ok := <-t.conn.inbox:
+		if !ok {
+			return nil, io.EOF
+		}
+		return raw, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Server tracks one clientConn (and JSON-RPC Peer) per connected
+// client_id.
 type Server struct {
-	clients   map[string]chan Request
-	responses map[string]chan Response
-	mutex     sync.RWMutex
+	// KeepAlive is how often /events sends a ping comment. Zero means
+	// defaultKeepAlive. Set it before the first request is served.
+	KeepAlive time.Duration
+
+	// Authenticator issues and verifies the bearer tokens that bind a
+	// client_id to the remote address it subscribed from. Defaults to
+	// an auth.HMACAuthenticator with a random per-process secret.
+	Authenticator auth.Authenticator
+
+	// InboundLimiter caps how fast each client can POST to /message;
+	// OutboundLimiter caps how fast /trigger can call a given client.
+	// Both default to defaultRPS/defaultBurst per client_id.
+	InboundLimiter  *ratelimit.Limiter
+	OutboundLimiter *ratelimit.Limiter
+
+	// ClientCAs, if set, enables mTLS in RunTLS: only clients
+	// presenting a certificate signed by one of these CAs may connect.
+	ClientCAs *x509.CertPool
+
+	mu           sync.RWMutex
+	clients      map[string]*clientConn
+	shuttingDown bool
+
+	inFlight sync.WaitGroup // in-flight /message POSTs, drained by Shutdown
 }
 
 func NewServer() *Server {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic("bidirectional_server: failed to generate auth secret: " + err.Error())
+	}
+
 	return &Server{
-		clients:   make(map[string]chan Request),
-		responses: make(map[string]chan Response),
+		KeepAlive:       defaultKeepAlive,
+		Authenticator:   auth.NewHMACAuthenticator(secret),
+		InboundLimiter:  ratelimit.NewLimiter(defaultRPS, defaultBurst),
+		OutboundLimiter: ratelimit.NewLimiter(defaultRPS, defaultBurst),
+		clients:         make(map[string]*clientConn),
+	}
+}
+
+// RunTLS serves the bidirectional transport over HTTPS on addr using
+// the given certificate/key pair. If s.ClientCAs is set, it also
+// requires and verifies a client certificate (mTLS) before the
+// application-level token check in handleMessage ever runs.
+func (s *Server) RunTLS(addr, certFile, keyFile string) error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.ClientCAs != nil {
+		tlsConfig.ClientCAs = s.ClientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	httpServer := &http.Server{
+		Addr:      addr,
+		Handler:   NewMux(s),
+		TLSConfig: tlsConfig,
 	}
+	return httpServer.ListenAndServeTLS(certFile, keyFile)
 }
 
-func (s *Server) addClient(clientID string) chan Request {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
-	requestChan := make(chan Request, 10)
-	s.clients[clientID] = requestChan
-	s.responses[clientID] = make(chan Response, 10)
-	
-	log.Printf("Client connected: %s", clientID)
-	return requestChan
+func (s *Server) client(clientID string) (*clientConn, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.clients[clientID]
+	return c, ok
 }
 
-func (s *Server) removeClient(clientID string) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
-	if ch, exists := s.clients[clientID]; exists {
-		close(ch)
-		delete(s.clients, clientID)
+// connect returns the clientConn for clientID, creating (and
+// starting its Peer) on first contact. isNew tells the caller
+// whether this is a fresh client or a reconnect. It returns false,
+// false while the server is shutting down.
+func (s *Server) connect(clientID string) (conn *clientConn, isNew, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return nil, false, false
 	}
-	if ch, exists := s.responses[clientID]; exists {
-		close(ch)
-		delete(s.responses, clientID)
+	if c, exists := s.clients[clientID]; exists {
+		return c, false, true
 	}
-	
-	log.Printf("Client disconnected: %s", clientID)
+	c := newClientConn()
+	s.clients[clientID] = c
+	return c, true, true
 }
 
-func (s *Server) sendRequest(clientID string, req Request) <-chan Response {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	if clientChan, exists := s.clients[clientID]; exists {
-		clientChan <- req
-		return s.responses[clientID]
+// Shutdown stops accepting new /events subscriptions, tells every
+// connected client to expect no more messages, and waits for
+// in-flight /message POSTs to finish, up to ctx's deadline.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	clients := make([]*clientConn, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.sendShutdown()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nil
 }
 
-func main() {
-	server := NewServer()
+func (s *Server) keepAlive() time.Duration {
+	if s.KeepAlive <= 0 {
+		return defaultKeepAlive
+	}
+	return s.KeepAlive
+}
 
-	// SSE endpoint for client to receive requests
-	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
-		clientID := r.URL.Query().Get("client_id")
-		if clientID == "" {
-			clientID = fmt.Sprintf("client_%d", time.Now().Unix())
-		}
+// NewMux builds the server's HTTP routes bound to server, so the
+// same wiring can be used by main and by tests against an
+// httptest.Server.
+func NewMux(server *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", server.handleEvents)
+	mux.HandleFunc("/message", server.handleMessage)
+	mux.HandleFunc("/trigger", server.handleTrigger)
+	mux.HandleFunc("/", server.handleStatus)
+	return mux
+}
 
-		// Set SSE headers
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+// handleEvents is the SSE endpoint the client subscribes to for
+// requests and replies on.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		clientID = fmt.Sprintf("client_%d", time.Now().UnixNano())
+	}
+
+	conn, isNew, ok := s.connect(clientID)
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "server is shutting down")
+		return
+	}
+	if isNew {
+		log.Printf("Client connected: %s", clientID)
+		go func() {
+			if err := conn.peer.Serve(context.Background()); err != nil {
+				log.Printf("Peer for %s stopped: %v", clientID, err)
+			}
+		}()
+	} else {
+		log.Printf("Client reconnected: %s", clientID)
+	}
+
+	token, err := s.Authenticator.IssueToken(clientID, r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "failed to issue token", http.StatusInternalServerError)
+		return
+	}
 
-		requestChan := server.addClient(clientID)
-		defer server.removeClient(clientID)
+	// Set SSE headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-		// Send client ID first
-		fmt.Fprintf(w, "data: {\"type\":\"client_id\",\"id\": \"%s\"}\n\n", clientID)
-		if flusher, ok := w.(http.Flusher); ok {
-			flusher.Flush()
-		}
+	flusher, _ := w.(http.Flusher)
 
-		// Stream requests to client
-		for {
-			select {
-			case req, ok := <-requestChan:
-				if !ok {
-					return
+	// Tell the client its id and auth token first. This is transport
+	// bootstrap, not a JSON-RPC message, so it isn't buffered for
+	// replay - a reconnect gets a freshly issued token instead.
+	fmt.Fprintf(w, "data: {\"type\":\"client_id\",\"id\": \"%s\",\"token\":\"%s\"}\n\n", clientID, token)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	// Replay anything the client missed while disconnected.
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		lastSeq, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			log.Printf("Ignoring malformed Last-Event-ID from %s: %q", clientID, lastID)
+		} else {
+			for _, sm := range conn.since(lastSeq) {
+				writeMessageEvent(w, sm)
+				if flusher != nil {
+					flusher.Flush()
 				}
-				
-				reqJSON, _ := json.Marshal(req)
-				fmt.Fprintf(w, "data: %s\n\n", reqJSON)
-				
-				if flusher, ok := w.(http.Flusher); ok {
+			}
+		}
+	}
+
+	ticker := time.NewTicker(s.keepAlive())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case sm := <-conn.outbox:
+			if sm.shutdown {
+				fmt.Fprint(w, "event: shutdown\ndata: {}\n\n")
+				if flusher != nil {
 					flusher.Flush()
 				}
-				
-			case <-r.Context().Done():
+				log.Printf("Client stream closed for shutdown: %s", clientID)
 				return
 			}
-		}
-	})
+			writeMessageEvent(w, sm)
+			if flusher != nil {
+				flusher.Flush()
+			}
 
-	// HTTP POST endpoint for client responses
-	http.HandleFunc("/response", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
+		case now := <-ticker.C:
+			fmt.Fprintf(w, ": ping %d\n\n", now.UnixNano())
+			if flusher != nil {
+				flusher.Flush()
+			}
 
-		var response Response
-		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		case <-r.Context().Done():
+			log.Printf("Client stream closed: %s", clientID)
 			return
 		}
+	}
+}
 
-		clientID := r.Header.Get("Client-ID")
-		
-		server.mutex.RLock()
-		if respChan, exists := server.responses[clientID]; exists {
-			respChan <- response
-		}
-		server.mutex.RUnlock()
-
-		w.WriteHeader(http.StatusOK)
-		log.Printf("Received response from %s: %s", clientID, response.Result)
-	})
-
-	// Test endpoint to trigger a request
-	http.HandleFunc("/trigger", func(w http.ResponseWriter, r *http.Request) {
-		clientID := r.URL.Query().Get("client_id")
-		message := r.URL.Query().Get("message")
-		
-		if clientID == "" || message == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, "Need client_id and message parameters")
-			return
-		}
+// handleMessage is the HTTP POST endpoint the client uses to send
+// JSON-RPC messages (responses to server calls, or calls/
+// notifications of its own).
+func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 
-		req := Request{
-			ID:      fmt.Sprintf("req_%d", time.Now().Unix()),
-			Method:  "analyze",
-			Message: message,
-		}
+	clientID := r.Header.Get("Client-ID")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if clientID == "" || token == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := s.Authenticator.Verify(clientID, r.RemoteAddr, token); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
-		log.Printf("Sending request to client %s: %s", clientID, message)
-		
-		// Send request and wait for response
-		respChan := server.sendRequest(clientID, req)
-		if respChan == nil {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Client not found")
-			return
-		}
+	if !s.InboundLimiter.Allow(clientID) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
 
-		// Wait for response with timeout
-		select {
-		case response := <-respChan:
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(response)
-			log.Printf("Got response: %s", response.Result)
-			
-		case <-time.After(30 * time.Second):
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conn, exists := s.client(clientID)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	select {
+	case conn.inbox <- json.RawMessage(body):
+	default:
+		log.Printf("Dropping message from %s: inbox full", clientID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTrigger is the test endpoint used to make an "analyze" call
+// against a connected client.
+func (s *Server) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	message := r.URL.Query().Get("message")
+
+	if clientID == "" || message == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Need client_id and message parameters")
+		return
+	}
+
+	conn, exists := s.client(clientID)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Client not found")
+		return
+	}
+
+	if !s.OutboundLimiter.Allow(clientID) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, "Rate limit exceeded")
+		return
+	}
+
+	log.Printf("Sending request to client %s: %s", clientID, message)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var result string
+	if err := conn.peer.Call(ctx, "analyze", map[string]string{"message": message}, &result); err != nil {
+		if ctx.Err() != nil {
 			w.WriteHeader(http.StatusRequestTimeout)
 			fmt.Fprint(w, "Request timeout")
 			log.Println("Request timed out")
+			return
 		}
-	})
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Request failed: %v", err)
+		log.Printf("Request failed: %v", err)
+		return
+	}
 
-	// Status page
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		html := `<!DOCTYPE html>
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": result})
+	log.Printf("Got response: %s", result)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	html := `<!DOCTYPE html>
 <html>
 <head><title>Bidirectional SSE Server</title></head>
 <body>
 	<h1>Bidirectional SSE + HTTP Server</h1>
-	<p>This demonstrates MCP-style bidirectional communication:</p>
+	<p>This demonstrates MCP-style bidirectional communication over JSON-RPC 2.0:</p>
 	<ul>
-		<li><strong>SSE Stream:</strong> Server â†’ Client requests</li>
-		<li><strong>HTTP POST:</strong> Client â†’ Server responses</li>
+		<li><strong>SSE Stream:</strong> Server → Client JSON-RPC messages</li>
+		<li><strong>HTTP POST:</strong> Client → Server JSON-RPC messages</li>
 	</ul>
 	<p><strong>Endpoints:</strong></p>
 	<ul>
 		<li><code>GET /events?client_id=test</code> - SSE stream for client</li>
-		<li><code>POST /response</code> - Client sends responses</li>
-		<li><code>GET /trigger?client_id=test&message=hello</code> - Trigger request</li>
+		<li><code>POST /message</code> - Client sends JSON-RPC messages</li>
+		<li><code>GET /trigger?client_id=test&message=hello</code> - Trigger an "analyze" call</li>
 	</ul>
 </body>
 </html>`
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprint(w, html)
-	})
-
-	log.Println("ðŸš€ Bidirectional SSE Server starting on :8082")
-	log.Println("ðŸ“± Open browser: http://localhost:8082")
-	log.Println("ðŸ”— SSE endpoint: http://localhost:8082/events?client_id=test")
-	log.Println("ðŸ“¤ Trigger: http://localhost:8082/trigger?client_id=test&message=hello")
-	
-	log.Fatal(http.ListenAndServe(":8082", nil))
-}
\ No newline at end of file
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, html)
+}
+
+// writeMessageEvent writes sm as an SSE frame carrying both the
+// JSON-RPC envelope and the id the client should echo back via
+// Last-Event-ID if it has to reconnect.
+func writeMessageEvent(w http.ResponseWriter, sm seqMessage) {
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", sm.seq, sm.raw)
+}
+
+func main() {
+	addr := flag.String("addr", ":8082", "listen address")
+	certFile := flag.String("tls-cert", "", "TLS certificate file (enables HTTPS when set with -tls-key)")
+	keyFile := flag.String("tls-key", "", "TLS key file (enables HTTPS when set with -tls-cert)")
+	flag.Parse()
+
+	server := NewServer()
+
+	scheme := "http"
+	if *certFile != "" && *keyFile != "" {
+		scheme = "https"
+	}
+
+	log.Printf("🚀 Bidirectional SSE Server starting on %s", *addr)
+	log.Printf("📱 Open browser: %s://localhost%s", scheme, *addr)
+	log.Printf("🔗 SSE endpoint: %s://localhost%s/events?client_id=test", scheme, *addr)
+	log.Printf("📤 Trigger: %s://localhost%s/trigger?client_id=test&message=hello", scheme, *addr)
+
+	var err error
+	if scheme == "https" {
+		err = server.RunTLS(*addr, *certFile, *keyFile)
+	} else {
+		err = (&http.Server{Addr: *addr, Handler: NewMux(server)}).ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hardwaylabs/learn-sse-bidirectional/go/sseclient"
+)
+
+func TestEventsSendsKeepAlivePings(t *testing.T) {
+	server := NewServer()
+	server.KeepAlive = 20 * time.Millisecond
+
+	ts := httptest.NewServer(NewMux(server))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/events?client_id=ping-test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Split(bufio.ScanLines)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), ": ping ") {
+			return
+		}
+	}
+	t.Fatal("did not observe a keepalive ping before the deadline")
+}
+
+// TestClientReconnectsAfterHijackClose simulates a proxy severing the
+// TCP connection mid-stream (the hijacked socket is closed right after
+// the bootstrap line, which the client reads as EOF) and checks that
+// sseclient.EventStream
+// reconnects and keeps delivering messages pushed on the server side.
+func TestClientReconnectsAfterHijackClose(t *testing.T) {
+	const clientID = "reconnect-test"
+	server := NewServer()
+
+	var severed int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&severed, 0, 1) {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("ResponseWriter does not support hijacking")
+			}
+			conn, bufrw, err := hj.Hijack()
+			if err != nil {
+				t.Fatalf("hijack: %v", err)
+			}
+			fmt.Fprint(bufrw, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\n")
+			fmt.Fprintf(bufrw, "data: {\"type\":\"client_id\",\"id\":\"%s\"}\n\n", clientID)
+			bufrw.Flush()
+			conn.Close() // no graceful close: just like a proxy dropping the socket
+			return
+		}
+		server.handleEvents(w, r)
+	})
+	mux.HandleFunc("/message", server.handleMessage)
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	stream := sseclient.Open(
+		ts.URL+"/events?client_id="+clientID,
+		sseclient.WithHTTPClient(ts.Client()),
+	)
+	defer stream.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// First Next drains the hijacked connection's bootstrap line; the
+	// second only arrives once readEvent has hit EOF, backed off, and
+	// reconnected through the real handler.
+	for i := 0; i < 2; i++ {
+		if _, err := stream.Next(ctx); err != nil {
+			t.Fatalf("Next (bootstrap %d): %v", i, err)
+		}
+	}
+
+	conn, ok := server.client(clientID)
+	if !ok {
+		t.Fatal("server never registered the reconnected client")
+	}
+	conn.push([]byte(`{"jsonrpc":"2.0","method":"ping"}`))
+
+	event, err := stream.Next(ctx)
+	if err != nil {
+		t.Fatalf("Next (pushed message): %v", err)
+	}
+	if event.Data != `{"jsonrpc":"2.0","method":"ping"}` {
+		t.Fatalf("got %q, want the pushed message", event.Data)
+	}
+}
@@ -0,0 +1,423 @@
+// Package jsonrpc implements JSON-RPC 2.0 request/response/notification
+// framing over an arbitrary duplex Transport, so that either side of a
+// connection can both serve inbound calls and make outbound ones using
+// the exact same envelope.
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version is the "jsonrpc" field required on every message.
+const Version = "2.0"
+
+// Standard JSON-RPC 2.0 error codes, plus the -32000 "server error"
+// reserved for application use.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeServerError    = -32000
+)
+
+// Error is a JSON-RPC error object. It implements the error
+// interface so handlers can return it (or any other error, which
+// gets wrapped as CodeInternalError).
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc: %s (code %d)", e.Message, e.Code)
+}
+
+// message is the wire envelope for every direction. Method set
+// means request (ID present) or notification (ID absent); Method
+// empty means response (Result or Error present). Deadline, when
+// set on a request, is the Unix millisecond time by which the
+// caller will have given up, so the handler side can bound its own
+// work to the same deadline even if the caller's own cancellation
+// notification is lost or delayed.
+type message struct {
+	JSONRPC  string          `json:"jsonrpc"`
+	ID       json.RawMessage `json:"id,omitempty"`
+	Method   string          `json:"method,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *Error          `json:"error,omitempty"`
+	Deadline int64           `json:"deadline_unix_ms,omitempty"`
+}
+
+func (m *message) isResponse() bool {
+	return m.Method == "" && (m.Result != nil || m.Error != nil)
+}
+
+func (m *message) valid() bool {
+	return m.JSONRPC == Version && (m.Method != "" || m.isResponse())
+}
+
+// Handler processes one inbound call or notification. A returned
+// error that is not already an *Error is reported to the caller as
+// CodeInternalError. Handlers may run concurrently and must be safe
+// for that; DecodeParams is the usual way to unmarshal Params.
+type Handler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// Transport is the minimal duplex channel a Peer needs: one whole
+// JSON-RPC message per Send/Recv call. A Peer doesn't care whether
+// messages cross the wire over SSE, an HTTP POST, a socket, or
+// anything else - see the transports built for the bidirectional
+// server and client.
+type Transport interface {
+	Send(ctx context.Context, msg json.RawMessage) error
+	Recv(ctx context.Context) (json.RawMessage, error)
+}
+
+// cancelMethod is the built-in notification a Peer sends when a Call's
+// context is canceled or times out before a response arrives, so the
+// other side can abort whatever handler goroutine is still working on
+// it. It is handled by Serve directly, not dispatched to a Handler.
+const cancelMethod = "$/cancelRequest"
+
+// cancelNotifyTimeout bounds how long sending a cancelMethod
+// notification is allowed to block, since by the time it's sent the
+// Call's own ctx is already done and can't be used for the Send.
+const cancelNotifyTimeout = 2 * time.Second
+
+type cancelParams struct {
+	ID json.RawMessage `json:"id"`
+}
+
+// call tracks one in-flight outbound request.
+type call struct {
+	resp   chan message
+	cancel context.CancelFunc
+}
+
+// Peer is a JSON-RPC 2.0 endpoint over a single duplex Transport.
+// It dispatches inbound requests/notifications to registered
+// handlers and tracks outbound calls by id so responses (however
+// out of order) reach the right caller. There is no client/server
+// distinction at this layer - either side of a connection runs a
+// Peer.
+type Peer struct {
+	transport Transport
+
+	handlersMu sync.RWMutex
+	handlers   map[string]Handler
+
+	nextID int64
+
+	pendingMu sync.Mutex
+	pending   map[string]*call
+
+	// inFlight holds the cancel func for each inbound call currently
+	// running in a handler goroutine, keyed by its id, so a
+	// cancelMethod notification can abort it.
+	inFlightMu sync.Mutex
+	inFlight   map[string]context.CancelFunc
+}
+
+// NewPeer returns a Peer communicating over transport. Call Serve
+// to start processing inbound messages.
+func NewPeer(transport Transport) *Peer {
+	return &Peer{
+		transport: transport,
+		handlers:  make(map[string]Handler),
+		pending:   make(map[string]*call),
+		inFlight:  make(map[string]context.CancelFunc),
+	}
+}
+
+// RegisterMethod registers h to handle inbound calls and
+// notifications named name, replacing any existing registration.
+func (p *Peer) RegisterMethod(name string, h Handler) {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+	p.handlers[name] = h
+}
+
+// Serve reads messages from the transport until it returns an error
+// or ctx is done, dispatching each to a handler (for requests and
+// notifications) or to the matching pending Call (for responses).
+// It blocks until the transport is exhausted and returns that
+// error.
+func (p *Peer) Serve(ctx context.Context) error {
+	for {
+		raw, err := p.transport.Recv(ctx)
+		if err != nil {
+			return err
+		}
+
+		var msg message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			continue // not a JSON object at all; nothing to reply to
+		}
+		if !msg.valid() {
+			if len(msg.ID) > 0 {
+				p.reply(ctx, msg.ID, nil, &Error{Code: CodeInvalidRequest, Message: "invalid request"})
+			}
+			continue
+		}
+
+		if msg.isResponse() {
+			p.resolve(msg)
+			continue
+		}
+		if msg.Method == cancelMethod {
+			p.cancelInFlight(msg.Params)
+			continue
+		}
+		go p.dispatch(ctx, msg)
+	}
+}
+
+// cancelInFlight aborts the handler goroutine running the call named
+// by params (a cancelParams envelope), if it's still in flight. A
+// cancel for an id that has already finished or was never seen is a
+// no-op.
+func (p *Peer) cancelInFlight(params json.RawMessage) {
+	var cp cancelParams
+	if err := json.Unmarshal(params, &cp); err != nil {
+		return
+	}
+
+	key := string(cp.ID)
+	p.inFlightMu.Lock()
+	cancel, ok := p.inFlight[key]
+	p.inFlightMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (p *Peer) dispatch(ctx context.Context, msg message) {
+	p.handlersMu.RLock()
+	h, ok := p.handlers[msg.Method]
+	p.handlersMu.RUnlock()
+
+	isCall := len(msg.ID) > 0
+
+	if !ok {
+		if isCall {
+			p.reply(ctx, msg.ID, nil, &Error{Code: CodeMethodNotFound, Message: "method not found: " + msg.Method})
+		}
+		return
+	}
+
+	handlerCtx, cancel := p.withDeadline(ctx, msg.Deadline)
+	defer cancel()
+
+	if isCall {
+		key := string(msg.ID)
+		p.inFlightMu.Lock()
+		p.inFlight[key] = cancel
+		p.inFlightMu.Unlock()
+		defer func() {
+			p.inFlightMu.Lock()
+			delete(p.inFlight, key)
+			p.inFlightMu.Unlock()
+		}()
+	}
+
+	result, err := p.invoke(handlerCtx, h, msg.Params)
+	if !isCall {
+		return // notification: handler ran, no reply is sent either way
+	}
+	if err != nil {
+		p.reply(ctx, msg.ID, nil, toError(err))
+		return
+	}
+	p.reply(ctx, msg.ID, result, nil)
+}
+
+// withDeadline derives a cancelable context from ctx, additionally
+// bounded by deadlineMS (a Unix millisecond time) if it's non-zero.
+func (p *Peer) withDeadline(ctx context.Context, deadlineMS int64) (context.Context, context.CancelFunc) {
+	if deadlineMS == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, time.UnixMilli(deadlineMS))
+}
+
+// invoke calls h, converting a panic into an internal error so one
+// bad handler can't take down Serve's read loop.
+func (p *Peer) invoke(ctx context.Context, h Handler, params json.RawMessage) (result any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{Code: CodeInternalError, Message: fmt.Sprintf("handler panic: %v", r)}
+		}
+	}()
+	return h(ctx, params)
+}
+
+func toError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Code: CodeInternalError, Message: err.Error()}
+}
+
+func (p *Peer) reply(ctx context.Context, id json.RawMessage, result any, rpcErr *Error) {
+	resp := message{JSONRPC: Version, ID: id, Error: rpcErr}
+	if rpcErr == nil {
+		b, err := json.Marshal(result)
+		if err != nil {
+			resp.Error = &Error{Code: CodeInternalError, Message: "failed to marshal result: " + err.Error()}
+		} else {
+			resp.Result = b
+		}
+	}
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return // can't even report this; drop it
+	}
+	_ = p.transport.Send(ctx, raw)
+}
+
+func (p *Peer) resolve(msg message) {
+	key := string(msg.ID)
+
+	p.pendingMu.Lock()
+	c, ok := p.pending[key]
+	if ok {
+		delete(p.pending, key)
+	}
+	p.pendingMu.Unlock()
+
+	if !ok {
+		// Late or unknown response: log it and drop it.
+		log.Printf("jsonrpc: dropping response for unknown or finished call %s", key)
+		return
+	}
+	select {
+	case c.resp <- msg:
+	default:
+	}
+}
+
+// Call sends method with params to the peer and blocks for the
+// matching response, or until ctx is canceled. If result is
+// non-nil, the response's result is decoded into it. An error
+// response comes back as *Error.
+func (p *Peer) Call(ctx context.Context, method string, params, result any) error {
+	id := atomic.AddInt64(&p.nextID, 1)
+	idRaw, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	paramsRaw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+
+	var deadline int64
+	if dl, ok := ctx.Deadline(); ok {
+		deadline = dl.UnixMilli()
+	}
+
+	raw, err := json.Marshal(message{JSONRPC: Version, ID: idRaw, Method: method, Params: paramsRaw, Deadline: deadline})
+	if err != nil {
+		return err
+	}
+
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	key := string(idRaw)
+	c := &call{resp: make(chan message, 1), cancel: cancel}
+	p.pendingMu.Lock()
+	p.pending[key] = c
+	p.pendingMu.Unlock()
+	defer func() {
+		p.pendingMu.Lock()
+		delete(p.pending, key)
+		p.pendingMu.Unlock()
+	}()
+
+	if err := p.transport.Send(ctx, raw); err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-c.resp:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil && len(msg.Result) > 0 {
+			return json.Unmarshal(msg.Result, result)
+		}
+		return nil
+	case <-callCtx.Done():
+		p.notifyCancel(idRaw)
+		return callCtx.Err()
+	}
+}
+
+// notifyCancel tells the peer to abort the call named by idRaw. It's
+// best-effort: the Call's own ctx is already done by the time this
+// runs, so it sends under a short independent timeout instead.
+func (p *Peer) notifyCancel(idRaw json.RawMessage) {
+	params, err := json.Marshal(cancelParams{ID: idRaw})
+	if err != nil {
+		return
+	}
+	raw, err := json.Marshal(message{JSONRPC: Version, Method: cancelMethod, Params: params})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cancelNotifyTimeout)
+	defer cancel()
+	_ = p.transport.Send(ctx, raw)
+}
+
+// Notify sends method with params without waiting for (or expecting)
+// a response.
+func (p *Peer) Notify(ctx context.Context, method string, params any) error {
+	paramsRaw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(message{JSONRPC: Version, Method: method, Params: paramsRaw})
+	if err != nil {
+		return err
+	}
+	return p.transport.Send(ctx, raw)
+}
+
+func marshalParams(params any) (json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	return json.Marshal(params)
+}
+
+// DecodeParams unmarshals raw into v, returning a CodeInvalidParams
+// *Error on failure so a Handler can return it directly:
+//
+//	func(ctx context.Context, params json.RawMessage) (any, error) {
+//		var args analyzeArgs
+//		if err := jsonrpc.DecodeParams(params, &args); err != nil {
+//			return nil, err
+//		}
+//		...
+//	}
+func DecodeParams(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package ratelimit implements a simple per-key token-bucket limiter,
+// used to cap how fast each client can POST responses or have
+// requests triggered against it.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a single token bucket: it refills at rate tokens per
+// second up to burst, and Allow reports whether a token was
+// available to spend.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a Bucket that allows up to burst requests
+// immediately and rate requests per second thereafter.
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow reports whether a token is available and, if so, spends it.
+func (b *Bucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Limiter hands out one Bucket per key, created lazily on first use
+// with the rate/burst the Limiter was constructed with.
+type Limiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// NewLimiter returns a Limiter whose per-key buckets allow burst
+// requests immediately and rate requests per second thereafter.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+// Allow reports whether key's bucket has a token to spend, creating
+// the bucket on first use.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	l.mu.Unlock()
+
+	return b.Allow()
+}
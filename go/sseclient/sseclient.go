@@ -0,0 +1,379 @@
+// Package sseclient implements a reconnecting Server-Sent Events client.
+//
+// Unlike a bare bufio.Scanner over an HTTP response body, EventStream
+// understands the full SSE wire format (event/id/data/retry fields,
+// multi-line data, comment lines) and transparently reconnects on
+// disconnect, resuming the stream with Last-Event-ID and backing off
+// using the server's retry hint.
+package sseclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a single fully-parsed Server-Sent Event.
+type Event struct {
+	// Type is the "event:" field, defaulting to "message" when the
+	// server omits it.
+	Type string
+	// ID is the "id:" field, if any. A non-empty ID becomes the
+	// Last-Event-ID sent on the next reconnect.
+	ID string
+	// Data is every "data:" field of the event joined with "\n".
+	Data string
+}
+
+const (
+	defaultRetry = 3 * time.Second
+	maxRetry     = 30 * time.Second
+
+	// defaultIdleTimeout is how long Next will tolerate a connection
+	// producing no bytes at all (not even a keepalive comment) before
+	// treating it as dead and reconnecting. It matches twice the
+	// bidirectional server's default 15s KeepAlive interval.
+	defaultIdleTimeout = 30 * time.Second
+)
+
+// EventStream is a reconnecting SSE client. Callers drive it by
+// calling Next in a loop; reconnection, Last-Event-ID tracking and
+// backoff all happen internally.
+type EventStream struct {
+	url         string
+	header      http.Header
+	client      *http.Client
+	idleTimeout time.Duration
+
+	mu           sync.Mutex
+	lastID       string
+	retry        time.Duration
+	resp         *http.Response
+	scanner      *bufio.Scanner
+	lastActivity time.Time
+	watchdogStop chan struct{}
+	closed       bool
+}
+
+// Option configures an EventStream returned by Open.
+type Option func(*EventStream)
+
+// WithHeader sets additional headers to send on every (re)connect.
+// Accept and Cache-Control are managed by the stream and always
+// overwritten; Last-Event-ID is overwritten once the stream has seen
+// an event id.
+func WithHeader(h http.Header) Option {
+	return func(es *EventStream) { es.header = h.Clone() }
+}
+
+// WithHTTPClient overrides the http.Client used to connect. Its
+// Timeout should be zero (or large) since SSE connections are
+// intentionally long-lived.
+func WithHTTPClient(c *http.Client) Option {
+	return func(es *EventStream) { es.client = c }
+}
+
+// WithIdleTimeout overrides how long a connection may go without
+// producing a single byte (event or keepalive comment) before it is
+// considered dead and reconnected.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(es *EventStream) { es.idleTimeout = d }
+}
+
+// Open returns a new EventStream for url. The first connection
+// attempt happens lazily, on the first call to Next.
+func Open(url string, opts ...Option) *EventStream {
+	es := &EventStream{
+		url:         url,
+		header:      make(http.Header),
+		client:      &http.Client{},
+		retry:       defaultRetry,
+		idleTimeout: defaultIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(es)
+	}
+	return es
+}
+
+// Next blocks until the next event arrives, transparently
+// reconnecting (with backoff) if the connection drops or the server
+// goes away. It only returns an error once ctx is done or the
+// stream has been closed.
+func (es *EventStream) Next(ctx context.Context) (Event, error) {
+	for {
+		es.mu.Lock()
+		closed := es.closed
+		es.mu.Unlock()
+		if closed {
+			return Event{}, io.EOF
+		}
+
+		if err := es.ensureConnected(ctx); err != nil {
+			if !es.wait(ctx) {
+				return Event{}, ctx.Err()
+			}
+			continue
+		}
+
+		ev, err := es.readEvent()
+		if err != nil {
+			es.disconnect()
+			if !es.wait(ctx) {
+				return Event{}, ctx.Err()
+			}
+			continue
+		}
+		return ev, nil
+	}
+}
+
+// Close tears down the underlying connection, if any, and causes
+// future calls to Next to return io.EOF.
+func (es *EventStream) Close() error {
+	es.mu.Lock()
+	es.closed = true
+	resp := es.resp
+	es.resp = nil
+	es.scanner = nil
+	stop := es.watchdogStop
+	es.watchdogStop = nil
+	es.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	if resp != nil {
+		return resp.Body.Close()
+	}
+	return nil
+}
+
+func (es *EventStream) ensureConnected(ctx context.Context) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.resp != nil {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, es.url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range es.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if es.lastID != "" {
+		req.Header.Set("Last-Event-ID", es.lastID)
+	}
+
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("sseclient: server returned status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Split(splitSSELine)
+
+	es.resp = resp
+	es.scanner = scanner
+	es.lastActivity = time.Now()
+
+	stop := make(chan struct{})
+	es.watchdogStop = stop
+	go es.watchdog(resp, stop)
+	return nil
+}
+
+// watchdog force-closes resp's body (unblocking a stuck scanner.Scan)
+// once the connection has gone idleTimeout without a single byte
+// arriving - the case a dead proxy or a silently-vanished server
+// leaves r.Context() unaware of for far too long.
+func (es *EventStream) watchdog(resp *http.Response, stop chan struct{}) {
+	ticker := time.NewTicker(es.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			es.mu.Lock()
+			current := es.resp == resp
+			idle := time.Since(es.lastActivity)
+			es.mu.Unlock()
+			if !current {
+				return
+			}
+			if idle > es.idleTimeout {
+				resp.Body.Close()
+				return
+			}
+		}
+	}
+}
+
+// readEvent consumes lines from the current connection until a
+// dispatch boundary (a blank line) or an error. It is only ever
+// called from Next, so it needs no lock of its own beyond the
+// fields it shares with reconnection and the watchdog (scanner,
+// lastID, retry, lastActivity).
+func (es *EventStream) readEvent() (Event, error) {
+	es.mu.Lock()
+	scanner := es.scanner
+	es.mu.Unlock()
+	if scanner == nil {
+		return Event{}, io.EOF
+	}
+
+	var ev Event
+	var data strings.Builder
+	haveData := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		es.mu.Lock()
+		es.lastActivity = time.Now()
+		es.mu.Unlock()
+
+		if line == "" {
+			if !haveData && ev.Type == "" && ev.ID == "" {
+				continue // blank line with nothing buffered yet
+			}
+			if ev.Type == "" {
+				ev.Type = "message"
+			}
+			ev.Data = data.String()
+			return ev, nil
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue // comment / keepalive
+		}
+
+		field, value := splitField(line)
+		switch field {
+		case "event":
+			ev.Type = value
+		case "id":
+			ev.ID = value
+			es.mu.Lock()
+			es.lastID = value
+			es.mu.Unlock()
+		case "data":
+			if haveData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			haveData = true
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				es.mu.Lock()
+				es.retry = time.Duration(ms) * time.Millisecond
+				es.mu.Unlock()
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// splitField splits an SSE line into its field name and value,
+// dropping a single leading space from the value as the spec
+// requires.
+func splitField(line string) (field, value string) {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return line, ""
+	}
+	field = line[:i]
+	value = strings.TrimPrefix(line[i+1:], " ")
+	return field, value
+}
+
+func (es *EventStream) disconnect() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.resp != nil {
+		es.resp.Body.Close()
+		es.resp = nil
+		es.scanner = nil
+	}
+	if es.watchdogStop != nil {
+		close(es.watchdogStop)
+		es.watchdogStop = nil
+	}
+}
+
+// wait backs off for the server-suggested retry interval (capped,
+// with jitter) before the next reconnect attempt. It returns false
+// if ctx is done first.
+func (es *EventStream) wait(ctx context.Context) bool {
+	es.mu.Lock()
+	delay := es.retry
+	es.mu.Unlock()
+
+	if delay <= 0 {
+		delay = defaultRetry
+	}
+	if delay > maxRetry {
+		delay = maxRetry
+	}
+	// Jitter in [delay/2, delay] to avoid a reconnect thundering herd.
+	half := delay / 2
+	delay = half + time.Duration(rand.Int63n(int64(half)+1))
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// splitSSELine is a bufio.SplitFunc that tokenizes on CR, LF or
+// CRLF line terminators, per the SSE spec.
+func splitSSELine(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\n':
+			return i + 1, data[:i], nil
+		case '\r':
+			if i+1 < len(data) {
+				if data[i+1] == '\n' {
+					return i + 2, data[:i], nil
+				}
+				return i + 1, data[:i], nil
+			}
+			if atEOF {
+				return i + 1, data[:i], nil
+			}
+			return 0, nil, nil // need more data to know if \n follows
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	if atEOF {
+		return 0, nil, io.EOF
+	}
+	return 0, nil, nil
+}